@@ -17,11 +17,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"runtime/debug"
 	"slices"
@@ -33,6 +38,7 @@ import (
 	"cloud.google.com/go/profiler"
 	"cloud.google.com/go/storage"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	expmetric "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
 	exptrace "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
@@ -40,6 +46,13 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/metric"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -47,7 +60,10 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 	"go.opentelemetry.io/otel/trace"
 
+	"golang.org/x/net/http2"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 
 	// Install google-c2p resolver, which is required for direct path.
 	_ "google.golang.org/grpc/xds/googledirectpath"
@@ -71,6 +87,21 @@ const (
 	appName              = "w1r3"
 	defaultMetricsPrefix = "ssb/w1r3"
 	defaultSampleRate    = 0.05
+
+	// telemetry exporter kinds accepted by -telemetry-exporter
+	exporterGCP      = "gcp"
+	exporterOTLPGRPC = "otlp-grpc"
+	exporterOTLPHTTP = "otlp-http"
+	exporterStdout   = "stdout"
+	defaultExporter  = exporterGCP
+
+	// download modes accepted by -download-mode
+	downloadFull       = "FULL"
+	downloadRanged     = "RANGED"
+	downloadMultiRange = "MULTI-RANGE"
+	// the number of distinct ranges fetched per READ[r] iteration in
+	// MULTI-RANGE mode.
+	multiRangeCount = 3
 )
 
 func main() {
@@ -105,6 +136,41 @@ func main() {
 	var metricsPrefix = flag.String("metrics-prefix", defaultMetricsPrefix,
 		"using a ad-hoc metrics prefix an be useful during development,"+
 			" as metrics cannot be updated without losing all existing data")
+	var telemetryExporter = flag.String("telemetry-exporter", defaultExporter,
+		fmt.Sprintf("the telemetry exporter used for traces and metrics: %s, %s, %s, or %s",
+			exporterGCP, exporterOTLPGRPC, exporterOTLPHTTP, exporterStdout))
+	var otlpEndpoint = flag.String("otlp-endpoint", "",
+		"the collector endpoint used by the OTLP exporters, for example localhost:4317")
+	var otlpHeaders = flag.String("otlp-headers", "",
+		"comma-separated key=value pairs sent as headers with each OTLP export, for example api-key=secret")
+	var otlpInsecure = flag.Bool("otlp-insecure", false,
+		"disable TLS when talking to the OTLP collector endpoint")
+	var prometheusListen = flag.String("prometheus-listen", "",
+		"if set, serve an OTel Prometheus scrape endpoint at http://<addr>/metrics,"+
+			" in addition to any other configured metric reader")
+	var httpMaxConnsPerHost = flag.Int("http-max-conns-per-host", 0,
+		"the maximum number of connections per host used by the JSON transport, 0 means no limit")
+	var httpMaxIdleConns = flag.Int("http-max-idle-conns", 100,
+		"the maximum number of idle (keep-alive) connections used by the JSON transport")
+	var httpIdleTimeout = flag.Duration("http-idle-timeout", 90*time.Second,
+		"how long an idle (keep-alive) connection is kept open by the JSON transport")
+	var http2Disable = flag.Bool("http2-disable", false,
+		"disable HTTP/2 for the JSON transport, forcing HTTP/1.1")
+	var httpResponseHeaderTimeout = flag.Duration("http-response-header-timeout", 0,
+		"how long to wait for a response header from the JSON transport, 0 means no timeout")
+	var downloadMode = flag.String("download-mode", downloadFull,
+		fmt.Sprintf("the download mode used by the benchmark: %s, %s, or %s",
+			downloadFull, downloadRanged, downloadMultiRange))
+	var rangeSize = flag.String("range-size", "4096:1048576",
+		"min:max range length in bytes, drawn uniformly at random, used by the"+
+			" RANGED and MULTI-RANGE download modes")
+	var resultsTable = flag.String("results-table", "",
+		"if set, stream every completed upload and download as a row to this BigQuery table"+
+			" (projects/P/datasets/D/tables/T) via the Storage Write API")
+	var verify = flag.Bool("verify", false,
+		"send CRC32C/MD5 checksums with every upload and verify the CRC32C of"+
+			" every FULL-mode download (ranged downloads are not verified),"+
+			" turning the benchmark into a continuous data-integrity canary")
 	flag.Parse()
 
 	if *projectID == "" {
@@ -115,6 +181,23 @@ func main() {
 		flag.Usage()
 		log.Fatal("-bucket is required")
 	}
+	switch *telemetryExporter {
+	case exporterGCP, exporterOTLPGRPC, exporterOTLPHTTP, exporterStdout:
+	default:
+		flag.Usage()
+		log.Fatalf("unknown -telemetry-exporter %q", *telemetryExporter)
+	}
+	switch *downloadMode {
+	case downloadFull, downloadRanged, downloadMultiRange:
+	default:
+		flag.Usage()
+		log.Fatalf("unknown -download-mode %q", *downloadMode)
+	}
+	rangeMin, rangeMax, err := parseRangeSize(*rangeSize)
+	if err != nil {
+		flag.Usage()
+		log.Fatalf("invalid -range-size: %v", err)
+	}
 	if len(transportArgs) == 0 {
 		transportArgs = append(transportArgs, JSON, GRPC_CFE, GRPC_DP)
 	}
@@ -131,20 +214,33 @@ func main() {
 		log.Fatalf("Cannot create instance name %v", err)
 	}
 
+	otlpCfg := otlpConfig{
+		endpoint: *otlpEndpoint,
+		headers:  parseOTLPHeaders(*otlpHeaders),
+		insecure: *otlpInsecure,
+	}
+
 	ctx := context.Background()
 	enableProfiler(*projectID, *deployment, *profileVersion)
-	cleanupTracing, err := enableTracing(ctx, *tracingRate, *projectID)
+	cleanupTracing, err := enableTracing(ctx, *telemetryExporter, *tracingRate, *projectID, otlpCfg)
 	if err != nil {
 		log.Fatalf("Error enabling Cloud Profiler exporter %v", err)
 	}
 	defer cleanupTracing()
-	cleanupMeter, err := enableMeter(ctx, *projectID, instance.String())
+	cleanupMeter, err := enableMeter(ctx, *telemetryExporter, *projectID, instance.String(), otlpCfg, *prometheusListen)
 	if err != nil {
 		log.Fatalf("Error enabling Cloud Trace exporter %v", err)
 	}
 	defer cleanupMeter()
 
-	transports, err := makeTransports(ctx, transportArgs)
+	httpCfg := httpTransportConfig{
+		maxConnsPerHost:       *httpMaxConnsPerHost,
+		maxIdleConns:          *httpMaxIdleConns,
+		idleTimeout:           *httpIdleTimeout,
+		http2Disable:          *http2Disable,
+		responseHeaderTimeout: *httpResponseHeaderTimeout,
+	}
+	transports, err := makeTransports(ctx, transportArgs, httpCfg)
 	if err != nil {
 		log.Fatalf("Error creating transports %v", err)
 	}
@@ -161,6 +257,14 @@ func main() {
 		log.Fatalf("Error creating uploaders: %v", err)
 	}
 
+	sink, err := newResultsSink(ctx, *resultsTable)
+	if err != nil {
+		log.Fatalf("Error creating results sink: %v", err)
+	}
+	defer sink.Close()
+
+	region, zone := detectCloudLocation(ctx)
+
 	versions := make(map[string]string)
 	bi, ok := debug.ReadBuildInfo()
 	if !ok {
@@ -184,6 +288,21 @@ func main() {
 	log.Printf("# Tracing Rate: %f", *tracingRate)
 	log.Printf("# Version for Profiler: %s", *profileVersion)
 	log.Printf("# Metrics Prefix: %s", *metricsPrefix)
+	log.Printf("# Telemetry Exporter: %s", *telemetryExporter)
+	if *prometheusListen != "" {
+		log.Printf("# Prometheus Listen: %s", *prometheusListen)
+	}
+	log.Printf("# HTTP Max Conns Per Host: %d", *httpMaxConnsPerHost)
+	log.Printf("# HTTP Max Idle Conns: %d", *httpMaxIdleConns)
+	log.Printf("# HTTP/2 Disabled: %v", *http2Disable)
+	log.Printf("# Download Mode: %s", *downloadMode)
+	if *downloadMode != downloadFull {
+		log.Printf("# Range Size: %d:%d", rangeMin, rangeMax)
+	}
+	if *resultsTable != "" {
+		log.Printf("# Results Table: %s", *resultsTable)
+	}
+	log.Printf("# Verify: %v", *verify)
 
 	tracer := otel.GetTracerProvider().Tracer(appName)
 	meter := otel.GetMeterProvider().Meter(appName)
@@ -196,22 +315,45 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot create ssb/w1r3/latency histogram: %v", err)
 	}
+	ttfbHistogram, err := meter.Float64Histogram(
+		*metricsPrefix+"/ttfb",
+		metric.WithDescription("Time to first byte for download operations."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(histogramBoundaries()...),
+	)
+	if err != nil {
+		log.Fatalf("Cannot create ssb/w1r3/ttfb histogram: %v", err)
+	}
+	integrityCounter, err := meter.Int64Counter(
+		*metricsPrefix+"/integrity_errors",
+		metric.WithDescription("The number of CRC32C/MD5 checksum mismatches detected."),
+	)
+	if err != nil {
+		log.Fatalf("Cannot create ssb/w1r3/integrity_errors counter: %v", err)
+	}
 
 	config := Config{
-		transports:  transports,
-		uploaders:   uploaders,
-		objectSizes: objectSizes,
-		bucketName:  *bucket,
-		deployment:  *deployment,
-		instance:    instance.String(),
-		versions:    versions,
-		iterations:  *iterations,
+		transports:   transports,
+		uploaders:    uploaders,
+		objectSizes:  objectSizes,
+		bucketName:   *bucket,
+		deployment:   *deployment,
+		instance:     instance.String(),
+		versions:     versions,
+		iterations:   *iterations,
+		downloadMode: *downloadMode,
+		rangeMin:     rangeMin,
+		rangeMax:     rangeMax,
+		region:       region,
+		zone:         zone,
+		sink:         sink,
+		verify:       *verify,
 	}
 
 	var wg sync.WaitGroup
 	launch := func() {
 		defer wg.Done()
-		worker(ctx, config, tracer, histogram)
+		worker(ctx, config, tracer, histogram, ttfbHistogram, integrityCounter)
 	}
 
 	wg.Add(*workers)
@@ -222,17 +364,25 @@ func main() {
 }
 
 type Config struct {
-	transports  []Transport
-	uploaders   []Uploader
-	objectSizes []int64
-	bucketName  string
-	deployment  string
-	instance    string
-	versions    map[string]string
-	iterations  int
+	transports   []Transport
+	uploaders    []Uploader
+	objectSizes  []int64
+	bucketName   string
+	deployment   string
+	instance     string
+	versions     map[string]string
+	iterations   int
+	downloadMode string
+	rangeMin     int64
+	rangeMax     int64
+	region       string
+	zone         string
+	sink         *resultsSink
+	verify       bool
 }
 
-func worker(ctx context.Context, config Config, tracer trace.Tracer, histogram metric.Float64Histogram) {
+func worker(ctx context.Context, config Config, tracer trace.Tracer, histogram metric.Float64Histogram,
+	ttfbHistogram metric.Float64Histogram, integrityCounter metric.Int64Counter) {
 	data := make([]byte, slices.Max(config.objectSizes))
 	rand.Read(data) // rand.Read() is deprecated, but good enough for this benchmark.
 	for i := range config.iterations {
@@ -257,19 +407,27 @@ func worker(ctx context.Context, config Config, tracer trace.Tracer, histogram m
 			attribute.String("ssb.version.protobuf", getVersion(config, "google.golang.org/protobuf")),
 			attribute.String("ssb.version.http", getVersion(config, "golang.org/x/net")),
 		}
+		if transport.name == JSON {
+			commonAttributes = append(commonAttributes,
+				attribute.Int("ssb.http.max-conns-per-host", transport.http.maxConnsPerHost),
+				attribute.Int("ssb.http.max-idle-conns", transport.http.maxIdleConns),
+				attribute.Bool("ssb.http2.disable", transport.http.http2Disable),
+			)
+		}
 
 		spanContext, span := tracer.Start(
 			ctx, "ssb::iteration", trace.WithAttributes(
 				append([]attribute.KeyValue{attribute.Int("ssb.iteration", i)}, commonAttributes...)...))
 
-		objectHandle, err := uploadStep(spanContext, tracer, histogram, commonAttributes,
-			config, uploader, transport, objectName, data[0:objectSize])
+		objectHandle, err := uploadStep(spanContext, tracer, histogram, integrityCounter, commonAttributes,
+			config, uploader, transport, objectName, data[0:objectSize], i)
 		if err != nil {
 			span.End()
 			continue
 		}
 
-		downloadStep(spanContext, tracer, histogram, commonAttributes, objectHandle)
+		downloadStep(spanContext, tracer, histogram, ttfbHistogram, integrityCounter, commonAttributes, objectHandle,
+			config, transport.name, objectSize, i)
 
 		d := objectHandle.Retryer(storage.WithPolicy(storage.RetryAlways))
 		d.Delete(spanContext)
@@ -279,21 +437,30 @@ func worker(ctx context.Context, config Config, tracer trace.Tracer, histogram m
 
 func uploadStep(ctx context.Context, tracer trace.Tracer,
 	histogram metric.Float64Histogram,
+	integrityCounter metric.Int64Counter,
 	commonAttributes []attribute.KeyValue,
 	config Config,
 	uploader Uploader,
 	transport Transport,
 	objectName string,
-	data []byte) (*storage.ObjectHandle, error) {
+	data []byte,
+	iteration int) (*storage.ObjectHandle, error) {
 	uploadContext, uploadSpan := tracer.Start(
 		ctx, "ssb::upload", trace.WithAttributes(
 			append([]attribute.KeyValue{attribute.String("ssb.op", uploader.name)}, commonAttributes...)...))
 
 	upload_start := time.Now()
-	objectHandle, err := uploader.uploader(uploadContext, transport.client, config.bucketName, objectName, data)
+	objectHandle, err := uploader.uploader(uploadContext, transport.client, config.bucketName, objectName, data, config.verify)
 	if err != nil {
 		uploadSpan.SetStatus(codes.Error, "error during upload")
 		uploadSpan.RecordError(err)
+		if config.verify && strings.Contains(strings.ToLower(err.Error()), "checksum") {
+			integrityCounter.Add(uploadContext, 1, metric.WithAttributes(
+				append([]attribute.KeyValue{
+					attribute.String("ssb.op", uploader.name),
+					attribute.String("ssb.direction", "upload"),
+				}, commonAttributes...)...))
+		}
 		uploadSpan.End()
 		return nil, err
 	}
@@ -301,42 +468,186 @@ func uploadStep(ctx context.Context, tracer trace.Tracer,
 	histogram.Record(uploadContext, duration.Seconds(), metric.WithAttributes(
 		append([]attribute.KeyValue{attribute.String("ssb.op", uploader.name)}, commonAttributes...)...))
 	uploadSpan.End()
+	config.sink.record(resultRowFromStep(config, uploadContext, transport.name, uploader.name,
+		uploader.name, int64(len(data)), duration, iteration))
 	return objectHandle, nil
 }
 
 func downloadStep(ctx context.Context, tracer trace.Tracer,
 	histogram metric.Float64Histogram,
+	ttfbHistogram metric.Float64Histogram,
+	integrityCounter metric.Int64Counter,
 	commonAttributes []attribute.KeyValue,
-	objectHandle *storage.ObjectHandle) {
+	objectHandle *storage.ObjectHandle,
+	config Config,
+	transportName string,
+	objectSize int64,
+	iteration int) {
+	mode, rangeMin, rangeMax := config.downloadMode, config.rangeMin, config.rangeMax
+	ranges := 1
+	if mode == downloadMultiRange {
+		ranges = multiRangeCount
+	}
 	for r := range 3 {
-		op := fmt.Sprintf("READ[%d]", r)
-		downloadContext, downloadSpan := tracer.Start(
-			ctx, "ssb::download", trace.WithAttributes(
-				append([]attribute.KeyValue{attribute.String("ssb.op", op)}, commonAttributes...)...))
+		// Each sub-range fetched in MULTI-RANGE mode is its own GCS request
+		// with its own offset/length, so it gets its own span and its own
+		// histogram point, the same as each top-level READ[r] iteration does.
+		// FULL and RANGED modes have a single sub-range (ranges == 1) and
+		// behave exactly as before.
+		for sub := 0; sub < ranges; sub++ {
+			op := fmt.Sprintf("READ[%d]", r)
+			if ranges > 1 {
+				op = fmt.Sprintf("READ[%d].%d", r, sub)
+			}
+			attrs := []attribute.KeyValue{attribute.String("ssb.op", op)}
+			var offset, length int64
+			if mode != downloadFull {
+				length = randomRangeLength(rangeMin, rangeMax, objectSize)
+				offset = randomRangeOffset(objectSize, length)
+				attrs = append(attrs,
+					attribute.Int64("ssb.range.offset", offset),
+					attribute.Int64("ssb.range.length", length))
+			}
+			attrs = append(attrs, commonAttributes...)
 
-		download_start := time.Now()
-		objectReader, err := objectHandle.NewReader(downloadContext)
-		if err != nil {
-			downloadSpan.SetStatus(codes.Error, "error while opening reader")
-			downloadSpan.RecordError(err)
-			downloadSpan.End()
-			continue
-		}
-		if _, err := io.Copy(io.Discard, objectReader); err != nil {
-			downloadSpan.SetStatus(codes.Error, "error while closing reader")
-			downloadSpan.RecordError(err)
+			downloadContext, downloadSpan := tracer.Start(
+				ctx, "ssb::download", trace.WithAttributes(attrs...))
+
+			// Only verify in FULL mode: a partial range cannot be compared against
+			// the object's whole-object CRC32C.
+			verifying := config.verify && mode == downloadFull
+			var hasher hash.Hash32
+			if verifying {
+				hasher = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+			}
+
+			download_start := time.Now()
+			var objectReader io.Reader
+			var err error
+			if mode == downloadFull {
+				objectReader, err = objectHandle.NewReader(downloadContext)
+			} else {
+				objectReader, err = objectHandle.NewRangeReader(downloadContext, offset, length)
+			}
+			var failed bool
+			var ttfb time.Time
+			var duration time.Duration
+			if err != nil {
+				downloadSpan.SetStatus(codes.Error, "error while opening reader")
+				downloadSpan.RecordError(err)
+				failed = true
+			} else {
+				ttfbReader := newTTFBReader(objectReader)
+				var reader io.Reader = ttfbReader
+				if hasher != nil {
+					reader = io.TeeReader(ttfbReader, hasher)
+				}
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					downloadSpan.SetStatus(codes.Error, "error while closing reader")
+					downloadSpan.RecordError(err)
+					failed = true
+				} else {
+					// Capture the timed duration here, before any verify-only work
+					// below, so -verify's extra metadata round-trip never inflates
+					// the recorded latency.
+					duration = time.Since(download_start)
+					ttfb = ttfbReader.firstByte
+				}
+			}
+			if !failed && verifying {
+				if attrs, err := objectHandle.Attrs(downloadContext); err != nil {
+					log.Printf("ssb: failed to fetch object attrs for verification: %v", err)
+				} else if hasher.Sum32() != attrs.CRC32C {
+					downloadSpan.SetStatus(codes.Error, "CRC32C mismatch")
+					integrityCounter.Add(downloadContext, 1, metric.WithAttributes(
+						append([]attribute.KeyValue{
+							attribute.String("ssb.op", op),
+							attribute.String("ssb.direction", "download"),
+						}, commonAttributes...)...))
+				}
+			}
 			downloadSpan.End()
-			continue
+			if failed {
+				continue
+			}
+			// Only record data in the histogram for successful downloads. Otherwise
+			// we are mixing results
+			histogram.Record(downloadContext, duration.Seconds(), metric.WithAttributes(attrs...))
+			if !ttfb.IsZero() {
+				ttfbHistogram.Record(downloadContext, ttfb.Sub(download_start).Seconds(), metric.WithAttributes(attrs...))
+			}
+			config.sink.record(resultRowFromStep(config, downloadContext, transportName, "",
+				op, objectSize, duration, iteration))
 		}
-		// Only record data in the histogram for successful downloads. Otherwise
-		// we are mixing results
-		downloadSpan.End()
-		duration := time.Since(download_start)
-		histogram.Record(downloadContext, duration.Seconds(), metric.WithAttributes(
-			append([]attribute.KeyValue{attribute.String("ssb.op", op)}, commonAttributes...)...))
 	}
 }
 
+// ttfbReader wraps an io.Reader, stamping the moment its first Read() call
+// returns so callers can measure time-to-first-byte.
+type ttfbReader struct {
+	r         io.Reader
+	stamped   bool
+	firstByte time.Time
+}
+
+func newTTFBReader(r io.Reader) *ttfbReader {
+	return &ttfbReader{r: r}
+}
+
+func (t *ttfbReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if !t.stamped {
+		t.stamped = true
+		t.firstByte = time.Now()
+	}
+	return n, err
+}
+
+// parseRangeSize parses the "min:max" syntax accepted by -range-size into a
+// pair of byte lengths.
+func parseRangeSize(value string) (int64, int64, error) {
+	before, after, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected min:max, got %q", value)
+	}
+	min, err := strconv.ParseInt(strings.TrimSpace(before), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseInt(strings.TrimSpace(after), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min <= 0 || max < min {
+		return 0, 0, fmt.Errorf("want 0 < min <= max, got %q", value)
+	}
+	return min, max, nil
+}
+
+// randomRangeLength picks a uniformly random range length in [min, max],
+// clamped to objectSize.
+func randomRangeLength(min, max, objectSize int64) int64 {
+	if max > objectSize {
+		max = objectSize
+	}
+	if min > max {
+		min = max
+	}
+	if min <= 0 {
+		return max
+	}
+	return min + rand.Int63n(max-min+1)
+}
+
+// randomRangeOffset picks a uniformly random offset such that
+// [offset, offset+length) fits within [0, objectSize).
+func randomRangeOffset(objectSize, length int64) int64 {
+	if length >= objectSize {
+		return 0
+	}
+	return rand.Int63n(objectSize - length + 1)
+}
+
 func getVersion(config Config, name string) string {
 	v, ok := config.versions[name]
 	if ok {
@@ -347,26 +658,42 @@ func getVersion(config Config, name string) string {
 
 type Uploader struct {
 	name     string
-	uploader func(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte) (*storage.ObjectHandle, error)
+	uploader func(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte, verify bool) (*storage.ObjectHandle, error)
 }
 
-func singleShotUpload(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte) (*storage.ObjectHandle, error) {
+// setIntegrityChecksums has the SDK send the precomputed CRC32C and MD5 of
+// data with the upload, so GCS rejects the write on a framing or corruption
+// bug instead of silently storing bad bytes.
+func setIntegrityChecksums(objectWriter *storage.Writer, data []byte) {
+	objectWriter.SendCRC32C = true
+	objectWriter.CRC32C = crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	sum := md5.Sum(data)
+	objectWriter.MD5 = sum[:]
+}
+
+func singleShotUpload(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte, verify bool) (*storage.ObjectHandle, error) {
 	bucket := client.Bucket(bucketName)
 	o := bucket.Object(objectName)
 	objectWriter := o.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
 	// Make the buffer large enough such that the data all fits in the buffer,
 	// and SDK will use a single-shot upload.
 	objectWriter.ChunkSize = len(data) + 256*KiB
+	if verify {
+		setIntegrityChecksums(objectWriter, data)
+	}
 	if _, err := io.Copy(objectWriter, bytes.NewBuffer(data)); err != nil {
 		return o, err
 	}
 	return o, objectWriter.Close()
 }
 
-func resumableUpload(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte) (*storage.ObjectHandle, error) {
+func resumableUpload(ctx context.Context, client *storage.Client, bucketName string, objectName string, data []byte, verify bool) (*storage.ObjectHandle, error) {
 	bucket := client.Bucket(bucketName)
 	o := bucket.Object(objectName)
 	objectWriter := o.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if verify {
+		setIntegrityChecksums(objectWriter, data)
+	}
 	// Pick a chunk size that (almost always) is small enough to force a
 	// resumable upload.
 	if len(data) > googleapi.DefaultUploadChunkSize {
@@ -410,23 +737,68 @@ func makeUploaders(names stringFlags) ([]Uploader, error) {
 type Transport struct {
 	name   string
 	client *storage.Client
+	// http is only populated for the JSON transport; it records the tuning
+	// applied to the underlying *http.Transport so it can be reported as
+	// span/metric attributes.
+	http httpTransportConfig
 }
 
-func makeTransports(ctx context.Context, flags []string) ([]Transport, error) {
+// httpTransportConfig tunes the *http.Transport used by the JSON transport.
+// Each field sets the like-named *http.Transport field; every other setting
+// of that transport (proxy, dial and TLS handshake timeouts, per-host idle
+// connection limit) is left at net/http's zero value.
+type httpTransportConfig struct {
+	maxConnsPerHost       int
+	maxIdleConns          int
+	idleTimeout           time.Duration
+	http2Disable          bool
+	responseHeaderTimeout time.Duration
+}
+
+// newJSONHTTPClient builds the *http.Client used by the JSON transport,
+// applying the connection-pool and HTTP/2 tuning requested via cfg. The
+// base transport is wrapped with htransport.NewTransport so the returned
+// client still carries the environment's application-default credentials,
+// the same as the client storage.NewClient would build for us.
+func newJSONHTTPClient(ctx context.Context, cfg httpTransportConfig) (*http.Client, error) {
+	base := &http.Transport{
+		MaxConnsPerHost:       cfg.maxConnsPerHost,
+		MaxIdleConns:          cfg.maxIdleConns,
+		IdleConnTimeout:       cfg.idleTimeout,
+		ResponseHeaderTimeout: cfg.responseHeaderTimeout,
+	}
+	if cfg.http2Disable {
+		base.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else if err := http2.ConfigureTransport(base); err != nil {
+		return nil, err
+	}
+	trans, err := htransport.NewTransport(ctx, base,
+		option.WithScopes(storage.ScopeFullControl, "https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: trans}, nil
+}
+
+func makeTransports(ctx context.Context, flags []string, httpCfg httpTransportConfig) ([]Transport, error) {
 	var transports = make([]Transport, 0)
 	for _, transport := range flags {
 		if transport == JSON {
-			client, err := storage.NewClient(ctx)
+			httpClient, err := newJSONHTTPClient(ctx, httpCfg)
+			if err != nil {
+				return nil, err
+			}
+			client, err := storage.NewClient(ctx, option.WithHTTPClient(httpClient))
 			if err != nil {
 				return nil, err
 			}
-			transports = append(transports, Transport{transport, client})
+			transports = append(transports, Transport{transport, client, httpCfg})
 		} else if transport == GRPC_CFE {
 			client, err := storage.NewGRPCClient(ctx)
 			if err != nil {
 				return nil, err
 			}
-			transports = append(transports, Transport{transport, client})
+			transports = append(transports, Transport{transport, client, httpTransportConfig{}})
 		} else if transport == GRPC_DP {
 			const xdsEnvVar = "GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS"
 			if err := os.Setenv(xdsEnvVar, "true"); err != nil {
@@ -436,7 +808,7 @@ func makeTransports(ctx context.Context, flags []string) ([]Transport, error) {
 			if err != nil {
 				return nil, err
 			}
-			transports = append(transports, Transport{transport, client})
+			transports = append(transports, Transport{transport, client, httpTransportConfig{}})
 			if err := os.Unsetenv(xdsEnvVar); err != nil {
 				return nil, err
 			}
@@ -447,9 +819,72 @@ func makeTransports(ctx context.Context, flags []string) ([]Transport, error) {
 	return transports, nil
 }
 
-// enableTracing turns on Open Telemetry tracing with export to Cloud Trace.
-func enableTracing(ctx context.Context, sampleRate float64, projectID string) (func(), error) {
-	exporter, err := exptrace.New(exptrace.WithProjectID(projectID))
+// otlpConfig holds the settings shared by the OTLP trace and metric
+// exporters.
+type otlpConfig struct {
+	endpoint string
+	headers  map[string]string
+	insecure bool
+}
+
+// parseOTLPHeaders parses a comma-separated list of key=value pairs, as
+// accepted by -otlp-headers, into a map suitable for
+// otlptracegrpc.WithHeaders/otlptracehttp.WithHeaders and their metric
+// counterparts.
+func parseOTLPHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	if value == "" {
+		return headers
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return headers
+}
+
+// newTraceExporter creates the sdktrace.SpanExporter selected by
+// -telemetry-exporter.
+func newTraceExporter(ctx context.Context, exporterKind string, projectID string, otlp otlpConfig) (sdktrace.SpanExporter, error) {
+	switch exporterKind {
+	case exporterOTLPGRPC:
+		opts := []otlptracegrpc.Option{}
+		if otlp.endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(otlp.endpoint))
+		}
+		if otlp.insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(otlp.headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(otlp.headers))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case exporterOTLPHTTP:
+		opts := []otlptracehttp.Option{}
+		if otlp.endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(otlp.endpoint))
+		}
+		if otlp.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(otlp.headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(otlp.headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case exporterStdout:
+		return stdouttrace.New()
+	default:
+		return exptrace.New(exptrace.WithProjectID(projectID))
+	}
+}
+
+// enableTracing turns on Open Telemetry tracing, exporting to the exporter
+// selected by exporterKind (Cloud Trace, OTLP, or stdout).
+func enableTracing(ctx context.Context, exporterKind string, sampleRate float64, projectID string, otlp otlpConfig) (func(), error) {
+	exporter, err := newTraceExporter(ctx, exporterKind, projectID, otlp)
 	if err != nil {
 		return nil, err
 	}
@@ -510,11 +945,64 @@ func histogramBoundaries() []float64 {
 	return boundaries
 }
 
-func enableMeter(ctx context.Context, projectID string, instance string) (func(), error) {
-	exporter, err := expmetric.New(
-		expmetric.WithProjectID(projectID),
-		expmetric.WithDisableCreateMetricDescriptors(),
-	)
+// newMetricExporter creates the sdkmetric.Exporter selected by
+// -telemetry-exporter.
+func newMetricExporter(ctx context.Context, exporterKind string, projectID string, otlp otlpConfig) (sdkmetric.Exporter, error) {
+	switch exporterKind {
+	case exporterOTLPGRPC:
+		opts := []otlpmetricgrpc.Option{}
+		if otlp.endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(otlp.endpoint))
+		}
+		if otlp.insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		if len(otlp.headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(otlp.headers))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case exporterOTLPHTTP:
+		opts := []otlpmetrichttp.Option{}
+		if otlp.endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(otlp.endpoint))
+		}
+		if otlp.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(otlp.headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(otlp.headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	case exporterStdout:
+		return stdoutmetric.New()
+	default:
+		return expmetric.New(
+			expmetric.WithProjectID(projectID),
+			expmetric.WithDisableCreateMetricDescriptors(),
+		)
+	}
+}
+
+// detectCloudLocation returns the GCP region and zone the benchmark is
+// running in, or two empty strings if they cannot be detected (for example,
+// when running outside of GCP).
+func detectCloudLocation(ctx context.Context) (region string, zone string) {
+	resource, err := gcp.NewDetector().Detect(ctx)
+	if err != nil {
+		return "", ""
+	}
+	for _, attr := range resource.Attributes() {
+		if attr.Key == semconv.CloudRegionKey {
+			region = attr.Value.AsString()
+		} else if attr.Key == semconv.CloudAvailabilityZoneKey {
+			zone = attr.Value.AsString()
+		}
+	}
+	return region, zone
+}
+
+func enableMeter(ctx context.Context, exporterKind string, projectID string, instance string, otlp otlpConfig, prometheusListen string) (func(), error) {
+	exporter, err := newMetricExporter(ctx, exporterKind, projectID, otlp)
 	if err != nil {
 		return nil, err
 	}
@@ -550,14 +1038,35 @@ func enableMeter(ctx context.Context, projectID string, instance string) (func()
 		return nil, err
 	}
 
-	meterProvider := sdkmetric.NewMeterProvider(
+	opts := []sdkmetric.Option{
 		sdkmetric.WithResource(res),
 		sdkmetric.WithReader(
 			sdkmetric.NewPeriodicReader(
 				exporter,
 				sdkmetric.WithInterval(60*time.Second),
 			)),
-	)
+	}
+
+	var promServer *http.Server
+	if prometheusListen != "" {
+		promReader, err := prometheus.New()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdkmetric.WithReader(promReader))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		promServer = &http.Server{Addr: prometheusListen, Handler: mux}
+		go func() {
+			log.Printf("Serving Prometheus metrics on %s/metrics", prometheusListen)
+			if err := promServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Prometheus scrape endpoint failed: %v", err)
+			}
+		}()
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(opts...)
 
 	// Register as global meter provider so that it can be used via otel.Meter
 	// and accessed using otel.GetMeterProvider.
@@ -572,6 +1081,11 @@ func enableMeter(ctx context.Context, projectID string, instance string) (func()
 		if err := meterProvider.Shutdown(context.Background()); err != nil {
 			log.Println(err)
 		}
+		if promServer != nil {
+			if err := promServer.Shutdown(context.Background()); err != nil {
+				log.Println(err)
+			}
+		}
 	}
 	return cleanup, nil
 }
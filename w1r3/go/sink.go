@@ -0,0 +1,299 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	storagepb "cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// resultsSinkBufferSize bounds the number of rows buffered between the
+// worker goroutines and the background goroutine that appends them to
+// BigQuery. When full, record() drops the row rather than blocking the
+// benchmark.
+const resultsSinkBufferSize = 10_000
+
+// resultsSinkBatchSize and resultsSinkFlushPeriod bound how long rows sit in
+// memory before being appended.
+const (
+	resultsSinkBatchSize   = 500
+	resultsSinkFlushPeriod = 1 * time.Second
+)
+
+// resultsTableSchema mirrors the span/metric attributes already recorded for
+// every completed upload+download iteration.
+var resultsTableSchema = &storagepb.TableSchema{
+	Fields: []*storagepb.TableFieldSchema{
+		{Name: "transport", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "uploader", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "object_size", Type: storagepb.TableFieldSchema_INT64},
+		{Name: "op", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "duration_seconds", Type: storagepb.TableFieldSchema_DOUBLE},
+		{Name: "sdk_version", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "grpc_version", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "protobuf_version", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "http_version", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "instance", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "deployment", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "region", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "zone", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "iteration", Type: storagepb.TableFieldSchema_INT64},
+		{Name: "trace_id", Type: storagepb.TableFieldSchema_STRING},
+		{Name: "span_id", Type: storagepb.TableFieldSchema_STRING},
+	},
+}
+
+// resultRow is a single completed upload or download operation, as reported
+// to the resultsSink.
+type resultRow struct {
+	Transport    string
+	Uploader     string
+	ObjectSize   int64
+	Op           string
+	DurationSecs float64
+	SDKVersion   string
+	GRPCVersion  string
+	ProtoVersion string
+	HTTPVersion  string
+	Instance     string
+	Deployment   string
+	Region       string
+	Zone         string
+	Iteration    int64
+	TraceID      string
+	SpanID       string
+}
+
+// resultRowFromStep builds the resultRow for an upload or download step.
+// uploader is empty for download rows, which instead identify themselves via
+// op (e.g. "READ[0]").
+func resultRowFromStep(config Config, ctx context.Context, transport, uploader, op string,
+	objectSize int64, duration time.Duration, iteration int) resultRow {
+	spanContext := trace.SpanContextFromContext(ctx)
+	return resultRow{
+		Transport:    transport,
+		Uploader:     uploader,
+		ObjectSize:   objectSize,
+		Op:           op,
+		DurationSecs: duration.Seconds(),
+		SDKVersion:   getVersion(config, "cloud.google.com/go/storage"),
+		GRPCVersion:  getVersion(config, "google.golang.org/grpc"),
+		ProtoVersion: getVersion(config, "google.golang.org/protobuf"),
+		HTTPVersion:  getVersion(config, "golang.org/x/net"),
+		Instance:     config.instance,
+		Deployment:   config.deployment,
+		Region:       config.region,
+		Zone:         config.zone,
+		Iteration:    int64(iteration),
+		TraceID:      spanContext.TraceID().String(),
+		SpanID:       spanContext.SpanID().String(),
+	}
+}
+
+// resultsSink streams completed benchmark iterations to BigQuery via the
+// Storage Write API, as an in-process alternative to the CSV export and
+// bq_cli load used for ad-hoc runs.
+type resultsSink struct {
+	client      *managedwriter.Client
+	stream      *managedwriter.ManagedStream
+	messageType *dynamicpb.MessageType
+	rows        chan *dynamicpb.Message
+	wg          sync.WaitGroup
+}
+
+// newResultsSink creates a resultsSink that streams rows to table (in
+// "projects/P/datasets/D/tables/T" form), or returns (nil, nil) if table is
+// empty, so that callers can always `defer sink.Close()`.
+func newResultsSink(ctx context.Context, table string) (*resultsSink, error) {
+	if table == "" {
+		return nil, nil
+	}
+	projectID, err := projectFromTableName(table)
+	if err != nil {
+		return nil, err
+	}
+	client, err := managedwriter.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(resultsTableSchema, "BenchmarkResult")
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	messageDescriptor, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		client.Close()
+		return nil, fmt.Errorf("adapted results schema is not a message descriptor")
+	}
+	normalized, err := adapt.NormalizeDescriptor(messageDescriptor)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stream, err := client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(table),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized),
+	)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	sink := &resultsSink{
+		client:      client,
+		stream:      stream,
+		messageType: dynamicpb.NewMessageType(messageDescriptor),
+		rows:        make(chan *dynamicpb.Message, resultsSinkBufferSize),
+	}
+	sink.wg.Add(1)
+	go sink.run(ctx)
+	return sink, nil
+}
+
+// projectFromTableName extracts the project ID from a
+// "projects/P/datasets/D/tables/T" table name.
+func projectFromTableName(table string) (string, error) {
+	parts := strings.Split(table, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "datasets" || parts[4] != "tables" {
+		return "", fmt.Errorf("invalid -results-table %q, want projects/P/datasets/D/tables/T", table)
+	}
+	return parts[1], nil
+}
+
+// record enqueues row to be appended to BigQuery. It never blocks: if the
+// buffer is full the row is dropped and a warning is logged. record is a
+// no-op on a nil sink, so it is safe to call even when -results-table was
+// not set.
+func (s *resultsSink) record(row resultRow) {
+	if s == nil {
+		return
+	}
+	msg := dynamicpb.NewMessage(s.messageType.Descriptor())
+	setString(msg, "transport", row.Transport)
+	setString(msg, "uploader", row.Uploader)
+	setInt64(msg, "object_size", row.ObjectSize)
+	setString(msg, "op", row.Op)
+	setDouble(msg, "duration_seconds", row.DurationSecs)
+	setString(msg, "sdk_version", row.SDKVersion)
+	setString(msg, "grpc_version", row.GRPCVersion)
+	setString(msg, "protobuf_version", row.ProtoVersion)
+	setString(msg, "http_version", row.HTTPVersion)
+	setString(msg, "instance", row.Instance)
+	setString(msg, "deployment", row.Deployment)
+	setString(msg, "region", row.Region)
+	setString(msg, "zone", row.Zone)
+	setInt64(msg, "iteration", row.Iteration)
+	setString(msg, "trace_id", row.TraceID)
+	setString(msg, "span_id", row.SpanID)
+
+	select {
+	case s.rows <- msg:
+	default:
+		log.Print("resultsSink: buffer full, dropping row")
+	}
+}
+
+func setString(msg *dynamicpb.Message, field string, value string) {
+	if fd := msg.Descriptor().Fields().ByName(protoreflect.Name(field)); fd != nil {
+		msg.Set(fd, protoreflect.ValueOfString(value))
+	}
+}
+
+func setInt64(msg *dynamicpb.Message, field string, value int64) {
+	if fd := msg.Descriptor().Fields().ByName(protoreflect.Name(field)); fd != nil {
+		msg.Set(fd, protoreflect.ValueOfInt64(value))
+	}
+}
+
+func setDouble(msg *dynamicpb.Message, field string, value float64) {
+	if fd := msg.Descriptor().Fields().ByName(protoreflect.Name(field)); fd != nil {
+		msg.Set(fd, protoreflect.ValueOfFloat64(value))
+	}
+}
+
+// run drains s.rows, batching rows into AppendRows calls until ctx is
+// cancelled or the channel is closed by Close().
+func (s *resultsSink) run(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(resultsSinkFlushPeriod)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, resultsSinkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		result, err := s.stream.AppendRows(ctx, batch)
+		if err != nil {
+			log.Printf("resultsSink: AppendRows failed: %v", err)
+		} else if _, err := result.GetResult(ctx); err != nil {
+			log.Printf("resultsSink: append response error: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case row, ok := <-s.rows:
+			if !ok {
+				flush()
+				return
+			}
+			encoded, err := proto.Marshal(row)
+			if err != nil {
+				log.Printf("resultsSink: failed to encode row: %v", err)
+				continue
+			}
+			batch = append(batch, encoded)
+			if len(batch) >= resultsSinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close drains any buffered rows and releases the underlying stream and
+// client. Close is a no-op on a nil sink.
+func (s *resultsSink) Close() {
+	if s == nil {
+		return
+	}
+	close(s.rows)
+	s.wg.Wait()
+	if err := s.stream.Close(); err != nil {
+		log.Printf("resultsSink: error closing stream: %v", err)
+	}
+	if err := s.client.Close(); err != nil {
+		log.Printf("resultsSink: error closing client: %v", err)
+	}
+}